@@ -0,0 +1,404 @@
+package clusterapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/docker/swarm-v2/api"
+	"github.com/docker/swarm-v2/manager/state"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// newContainerServiceSpec returns a minimal ServiceSpec that passes
+// validateServiceSpec, for tests that only care about name/idempotency/
+// update behavior rather than template validation.
+func newContainerServiceSpec(name string) *api.ServiceSpec {
+	return &api.ServiceSpec{
+		Annotations: api.Annotations{Name: name},
+		Template: &api.TaskSpec{
+			Runtime: &api.TaskSpec_Container{
+				Container: &api.ContainerSpec{
+					Image: &api.Image{Reference: "redis:3.0.7"},
+				},
+			},
+		},
+	}
+}
+
+func newTestServer() *Server {
+	return &Server{store: state.NewMemoryStore(nil)}
+}
+
+func TestServiceSpecDigestDeterministic(t *testing.T) {
+	spec := &api.ServiceSpec{
+		Annotations: api.Annotations{
+			Name: "web",
+			Labels: map[string]string{
+				"a": "1",
+				"b": "2",
+				"c": "3",
+			},
+		},
+	}
+
+	first, err := serviceSpecDigest(spec)
+	if err != nil {
+		t.Fatalf("serviceSpecDigest: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		digest, err := serviceSpecDigest(spec)
+		if err != nil {
+			t.Fatalf("serviceSpecDigest: %v", err)
+		}
+		if digest != first {
+			t.Fatalf("digest changed across calls with identical labels: %s != %s", digest, first)
+		}
+	}
+}
+
+func TestServiceSpecDigestDiffers(t *testing.T) {
+	a := &api.ServiceSpec{Annotations: api.Annotations{Name: "web"}}
+	b := &api.ServiceSpec{Annotations: api.Annotations{Name: "api"}}
+
+	da, err := serviceSpecDigest(a)
+	if err != nil {
+		t.Fatalf("serviceSpecDigest: %v", err)
+	}
+	db, err := serviceSpecDigest(b)
+	if err != nil {
+		t.Fatalf("serviceSpecDigest: %v", err)
+	}
+	if da == db {
+		t.Fatal("expected different digests for different specs")
+	}
+}
+
+func TestInsertServiceSpecDefaults(t *testing.T) {
+	spec := &api.ServiceSpec{
+		Template: &api.TaskSpec{},
+	}
+
+	merged := insertServiceSpecDefaults(spec)
+	if merged.Template.Restart == nil {
+		t.Error("expected Restart to be filled in with a default")
+	}
+	if merged.Template.Placement == nil {
+		t.Error("expected Placement to be filled in with a default")
+	}
+	if merged.Update == nil {
+		t.Error("expected Update to be filled in with a default")
+	}
+
+	// The original spec must be untouched.
+	if spec.Template.Restart != nil {
+		t.Error("insertServiceSpecDefaults must not mutate the original spec")
+	}
+}
+
+func TestNodeEligibleForGlobalService(t *testing.T) {
+	cases := []struct {
+		name     string
+		node     *api.Node
+		eligible bool
+	}{
+		{
+			name: "active and ready",
+			node: &api.Node{
+				Spec:   api.NodeSpec{Availability: api.NodeAvailabilityActive},
+				Status: api.NodeStatus{State: api.NodeStatusReady},
+			},
+			eligible: true,
+		},
+		{
+			name: "drained",
+			node: &api.Node{
+				Spec:   api.NodeSpec{Availability: api.NodeAvailabilityDrain},
+				Status: api.NodeStatus{State: api.NodeStatusReady},
+			},
+			eligible: false,
+		},
+		{
+			name: "down",
+			node: &api.Node{
+				Spec:   api.NodeSpec{Availability: api.NodeAvailabilityActive},
+				Status: api.NodeStatus{State: api.NodeStatusDown},
+			},
+			eligible: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := nodeEligibleForGlobalService(c.node); got != c.eligible {
+				t.Errorf("nodeEligibleForGlobalService() = %v, want %v", got, c.eligible)
+			}
+		})
+	}
+}
+
+// newPluginServiceSpec returns a ServiceSpec for the "plugin" runtime, whose
+// validator (validatePluginRuntime) is never registered: init() registers
+// only "container". CreateService must therefore reject it with
+// Unimplemented rather than accept a service that can never run.
+func newPluginServiceSpec(name string) *api.ServiceSpec {
+	return &api.ServiceSpec{
+		Annotations: api.Annotations{Name: name},
+		Template: &api.TaskSpec{
+			RuntimeType: "plugin",
+			RuntimeData: &api.TypedData{TypeURL: "type.googleapis.com/example.Plugin"},
+		},
+	}
+}
+
+func TestCreateServiceRejectsUnregisteredRuntime(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+
+	_, err := s.CreateService(ctx, &api.CreateServiceRequest{Spec: newPluginServiceSpec("web")})
+	if grpc.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected Unimplemented for an unregistered runtime, got %v", err)
+	}
+}
+
+func TestCreateServiceRejectsRegistryAuth(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+
+	_, err := s.CreateService(ctx, &api.CreateServiceRequest{
+		Spec:                newContainerServiceSpec("web"),
+		EncodedRegistryAuth: encodedAuthToken(t, "alice"),
+	})
+	if grpc.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected Unimplemented for EncodedRegistryAuth, got %v", err)
+	}
+}
+
+func TestCreateServiceRejectsDuplicateName(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+
+	if _, err := s.CreateService(ctx, &api.CreateServiceRequest{Spec: newContainerServiceSpec("web")}); err != nil {
+		t.Fatalf("CreateService: %v", err)
+	}
+
+	_, err := s.CreateService(ctx, &api.CreateServiceRequest{Spec: newContainerServiceSpec("web")})
+	if grpc.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists for a duplicate name, got %v", err)
+	}
+}
+
+func TestCreateServiceIdempotentReturnsExistingService(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+
+	spec := newContainerServiceSpec("web")
+	first, err := s.CreateService(ctx, &api.CreateServiceRequest{Spec: spec})
+	if err != nil {
+		t.Fatalf("CreateService: %v", err)
+	}
+
+	retry, err := s.CreateService(ctx, &api.CreateServiceRequest{
+		Spec:       newContainerServiceSpec("web"),
+		Idempotent: true,
+	})
+	if err != nil {
+		t.Fatalf("idempotent CreateService: %v", err)
+	}
+	if retry.Service.ID != first.Service.ID {
+		t.Fatalf("idempotent retry returned a different service: %s != %s", retry.Service.ID, first.Service.ID)
+	}
+}
+
+func TestCreateServiceIdempotentRejectsConflictingSpec(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+
+	if _, err := s.CreateService(ctx, &api.CreateServiceRequest{Spec: newContainerServiceSpec("web")}); err != nil {
+		t.Fatalf("CreateService: %v", err)
+	}
+
+	conflicting := newContainerServiceSpec("web")
+	conflicting.Template.GetContainer().Image.Reference = "redis:4.0.0"
+
+	_, err := s.CreateService(ctx, &api.CreateServiceRequest{Spec: conflicting, Idempotent: true})
+	if grpc.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists for a conflicting spec under the same name, got %v", err)
+	}
+}
+
+func TestGetServiceResolvesNameOrID(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+
+	created, err := s.CreateService(ctx, &api.CreateServiceRequest{Spec: newContainerServiceSpec("web")})
+	if err != nil {
+		t.Fatalf("CreateService: %v", err)
+	}
+
+	byID, err := s.GetService(ctx, &api.GetServiceRequest{ServiceID: created.Service.ID})
+	if err != nil {
+		t.Fatalf("GetService by ID: %v", err)
+	}
+	if byID.Service.ID != created.Service.ID {
+		t.Fatalf("GetService by ID returned %s, want %s", byID.Service.ID, created.Service.ID)
+	}
+
+	byName, err := s.GetService(ctx, &api.GetServiceRequest{ServiceID: "web"})
+	if err != nil {
+		t.Fatalf("GetService by name: %v", err)
+	}
+	if byName.Service.ID != created.Service.ID {
+		t.Fatalf("GetService by name returned %s, want %s", byName.Service.ID, created.Service.ID)
+	}
+}
+
+// encodedAuthToken returns a valid base64-encoded AuthConfig for use as
+// request.EncodedRegistryAuth in tests.
+func encodedAuthToken(t *testing.T, username string) string {
+	t.Helper()
+	data, err := json.Marshal(api.AuthConfig{Username: username})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+func TestUpdateServiceByNameResolvesToService(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+
+	created, err := s.CreateService(ctx, &api.CreateServiceRequest{Spec: newContainerServiceSpec("web")})
+	if err != nil {
+		t.Fatalf("CreateService: %v", err)
+	}
+
+	newSpec := newContainerServiceSpec("web")
+	newSpec.Template.GetContainer().Image.Reference = "redis:4.0.0"
+
+	updated, err := s.UpdateService(ctx, &api.UpdateServiceRequest{
+		ServiceID:      "web",
+		ServiceVersion: &created.Service.Version,
+		Spec:           newSpec,
+	})
+	if err != nil {
+		t.Fatalf("UpdateService by name: %v", err)
+	}
+	if updated.Service.ID != created.Service.ID {
+		t.Fatalf("UpdateService by name updated %s, want %s", updated.Service.ID, created.Service.ID)
+	}
+	if updated.Service.Spec.Template.GetContainer().Image.Reference != "redis:4.0.0" {
+		t.Error("expected the new image reference to be applied")
+	}
+}
+
+func TestUpdateServiceRejectsRegistryAuth(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+
+	created, err := s.CreateService(ctx, &api.CreateServiceRequest{Spec: newContainerServiceSpec("web")})
+	if err != nil {
+		t.Fatalf("CreateService: %v", err)
+	}
+
+	_, err = s.UpdateService(ctx, &api.UpdateServiceRequest{
+		ServiceID:           created.Service.ID,
+		ServiceVersion:      &created.Service.Version,
+		Spec:                newContainerServiceSpec("web"),
+		EncodedRegistryAuth: encodedAuthToken(t, "alice"),
+	})
+	if grpc.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected Unimplemented for EncodedRegistryAuth, got %v", err)
+	}
+}
+
+func TestRemoveServicesPartialFailureIsNotRolledBack(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+
+	created, err := s.CreateService(ctx, &api.CreateServiceRequest{Spec: newContainerServiceSpec("web")})
+	if err != nil {
+		t.Fatalf("CreateService: %v", err)
+	}
+
+	resp, err := s.RemoveServices(ctx, &api.RemoveServicesRequest{
+		ServiceIDs: []string{created.Service.ID, "does-not-exist"},
+	})
+	if err != nil {
+		t.Fatalf("RemoveServices: %v", err)
+	}
+	if len(resp.Statuses) != 2 {
+		t.Fatalf("expected 2 statuses, got %d", len(resp.Statuses))
+	}
+
+	var removed, notFound int
+	for _, status := range resp.Statuses {
+		switch status.State {
+		case api.RemoveServicesResponse_REMOVED:
+			removed++
+		case api.RemoveServicesResponse_NOT_FOUND:
+			notFound++
+		}
+	}
+	if removed != 1 || notFound != 1 {
+		t.Fatalf("expected 1 REMOVED and 1 NOT_FOUND status, got %d REMOVED, %d NOT_FOUND", removed, notFound)
+	}
+
+	// The real service must be gone despite the batch containing a
+	// nonexistent ID: a per-service failure does not roll back the rest.
+	_, err = s.GetService(ctx, &api.GetServiceRequest{ServiceID: created.Service.ID})
+	if grpc.Code(err) != codes.NotFound {
+		t.Fatalf("expected the existing service to have been removed, got %v", err)
+	}
+}
+
+func TestRemoveServicesByOptionsQuery(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+
+	if _, err := s.CreateService(ctx, &api.CreateServiceRequest{Spec: newContainerServiceSpec("web")}); err != nil {
+		t.Fatalf("CreateService: %v", err)
+	}
+	if _, err := s.CreateService(ctx, &api.CreateServiceRequest{Spec: newContainerServiceSpec("api")}); err != nil {
+		t.Fatalf("CreateService: %v", err)
+	}
+
+	// An empty Query must match ListServices' semantics for the same field:
+	// it selects every service, not none.
+	resp, err := s.RemoveServices(ctx, &api.RemoveServicesRequest{Options: &api.ListServicesRequest_Options{}})
+	if err != nil {
+		t.Fatalf("RemoveServices: %v", err)
+	}
+	if len(resp.Statuses) != 2 {
+		t.Fatalf("expected an empty Query to select both services, got %d statuses", len(resp.Statuses))
+	}
+
+	list, err := s.ListServices(ctx, &api.ListServicesRequest{})
+	if err != nil {
+		t.Fatalf("ListServices: %v", err)
+	}
+	if len(list.Services) != 0 {
+		t.Fatalf("expected no services left after RemoveServices with an empty Query, got %d", len(list.Services))
+	}
+}
+
+func TestRemoveServiceByName(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+
+	created, err := s.CreateService(ctx, &api.CreateServiceRequest{Spec: newContainerServiceSpec("web")})
+	if err != nil {
+		t.Fatalf("CreateService: %v", err)
+	}
+
+	if _, err := s.RemoveService(ctx, &api.RemoveServiceRequest{ServiceID: "web"}); err != nil {
+		t.Fatalf("RemoveService by name: %v", err)
+	}
+
+	_, err = s.GetService(ctx, &api.GetServiceRequest{ServiceID: created.Service.ID})
+	if grpc.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound after removal by name, got %v", err)
+	}
+}